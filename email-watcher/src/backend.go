@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	// gmailPollInterval is the default interval GmailBackend re-polls for
+	// unread messages at, overridable via GMAIL_POLL_INTERVAL.
+	gmailPollInterval = 1 * time.Minute
+
+	// gmailMaxPollBackoff caps how far GmailBackend backs off after repeated
+	// polling errors.
+	gmailMaxPollBackoff = 10 * time.Minute
+)
+
+// MessageHandler receives the parsed context of each new message a Backend
+// discovers, typically a RuleEngine's Evaluate method.
+type MessageHandler func(ctx EmailContext)
+
+// Backend abstracts over the mail source a watcher pulls messages from, so
+// that the rest of the pipeline (rule matching, actions, etc.) doesn't care
+// whether messages come from Gmail or a plain IMAP server.
+type Backend interface {
+	// Authenticate establishes credentials with the mail source.
+	Authenticate() error
+
+	// Watch blocks, invoking handler for every new message it sees, until
+	// ctx is cancelled or an unrecoverable error occurs.
+	Watch(ctx context.Context, handler MessageHandler) error
+}
+
+// GmailBackend is a Backend backed by the Gmail API, reusing the existing
+// EmailWatcher polling logic.
+type GmailBackend struct {
+	ew           *EmailWatcher
+	pollInterval time.Duration
+}
+
+// newGmailBackend wraps an EmailWatcher as a Backend, polling at
+// gmailPollInterval unless overridden by GMAIL_POLL_INTERVAL (a
+// time.ParseDuration string, e.g. "90s").
+func newGmailBackend(ew *EmailWatcher) *GmailBackend {
+	interval := gmailPollInterval
+	if v := os.Getenv("GMAIL_POLL_INTERVAL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("Warning: invalid GMAIL_POLL_INTERVAL %q, using default %s", v, gmailPollInterval)
+		} else {
+			interval = parsed
+		}
+	}
+	return &GmailBackend{ew: ew, pollInterval: interval}
+}
+
+func (b *GmailBackend) Authenticate() error {
+	return b.ew.authenticate()
+}
+
+// Watch polls on pollInterval, backing off with jitter on repeated errors
+// instead of giving up after the first one.
+func (b *GmailBackend) Watch(ctx context.Context, handler MessageHandler) error {
+	backoff := b.pollInterval
+
+	for {
+		if err := b.ew.watchEmailsWith(handler); err != nil {
+			apiErrorsTotal.WithLabelValues("gmail").Inc()
+			slog.Error("gmail poll iteration failed", "error", err)
+			backoff = nextBackoff(backoff, gmailMaxPollBackoff)
+		} else {
+			daemonHealth.recordSync()
+			backoff = b.pollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// healthStatus tracks the process's readiness signals so /healthz and
+// /readyz can report them without reaching back into backend internals.
+type healthStatus struct {
+	mu          sync.RWMutex
+	ready       bool
+	tokenExpiry time.Time
+	lastSync    time.Time
+}
+
+// daemonHealth is the single healthStatus instance shared by every backend,
+// mirroring the package-level Prometheus metrics in metrics.go.
+var daemonHealth = &healthStatus{}
+
+func (h *healthStatus) setReady(ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = ready
+}
+
+func (h *healthStatus) setTokenExpiry(expiry time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokenExpiry = expiry
+}
+
+func (h *healthStatus) recordSync() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSync = time.Now()
+}
+
+func (h *healthStatus) snapshot() (ready bool, tokenExpiry, lastSync time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ready, h.tokenExpiry, h.lastSync
+}
+
+func (h *healthStatus) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	_, tokenExpiry, lastSync := h.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "ok",
+		"token_expiry": tokenExpiry,
+		"last_sync":    lastSync,
+	})
+}
+
+// handleReadyz reports 200 only once a backend has signaled it's ready and,
+// if a token expiry is known, that token isn't stale.
+func (h *healthStatus) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, tokenExpiry, lastSync := h.snapshot()
+	tokenFresh := tokenExpiry.IsZero() || time.Now().Before(tokenExpiry)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready || !tokenFresh {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":        ready && tokenFresh,
+		"token_expiry": tokenExpiry,
+		"last_sync":    lastSync,
+	})
+}
+
+// serveDaemonHTTP serves /metrics, /healthz, and /readyz until ctx is
+// cancelled, then shuts the server down gracefully.
+func serveDaemonHTTP(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", daemonHealth.handleHealthz)
+	mux.HandleFunc("/readyz", daemonHealth.handleReadyz)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("serving metrics and health endpoints", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("daemon HTTP server error", "error", err)
+	}
+}
+
+// nextBackoff doubles current, capped at max.
+func nextBackoff(current, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// jitter returns d randomized down to as little as half its value, so that
+// watchers recovering from the same outage don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
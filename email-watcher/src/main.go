@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -16,21 +21,26 @@ import (
 )
 
 type EmailWatcher struct {
-	service *gmail.Service
-	config  *oauth2.Config
-	token   *oauth2.Token
+	service    *gmail.Service
+	config     *oauth2.Config
+	token      *oauth2.Token
+	tokenStore TokenStore
+
 	lastProcessedEmailID string
 }
 
 const (
-	tokenFileName = "gmail_token.json"
-	tokenSubdir   = ".config/ai-thing/tokens"
+	tokenFileName       = "gmail_token.json"
+	tokenSubdir         = ".config/ai-thing/tokens"
 	lastEmailIDFileName = "last_processed_email.json"
+	rulesSubdir         = ".config/ai-thing"
+	rulesFileName       = "rules.yaml"
 )
 
 // Structure to save last processed email ID
 type LastProcessedEmail struct {
-	EmailID string `json:"email_id"`
+	EmailID   string `json:"email_id"`
+	HistoryID uint64 `json:"history_id,omitempty"`
 }
 
 func getTokenFilePath() (string, error) {
@@ -66,72 +76,56 @@ func getTokenFilePath() (string, error) {
 	return tokenPath, nil
 }
 
-func newEmailWatcher() (*EmailWatcher, error) {
+func newEmailWatcher(tokenStoreKind string) (*EmailWatcher, error) {
 	// OAuth 2.0 configuration
 	config := &oauth2.Config{
 		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
 		Scopes:       []string{gmail.GmailReadonlyScope},
 		Endpoint:     google.Endpoint,
-		RedirectURL:  "urn:ietf:wg:oauth:2.0:oob",
+		// RedirectURL is set per-authentication by authenticateLoopback,
+		// since it depends on the ephemeral port the callback server binds.
+	}
+
+	tokenStore, err := selectTokenStore(tokenStoreKind)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up token store: %v", err)
 	}
 
 	return &EmailWatcher{
-		config: config,
+		config:     config,
+		tokenStore: tokenStore,
 	}, nil
 }
 
-// loadToken attempts to load a previously saved token
+// loadToken attempts to load a previously saved token via ew.tokenStore
 func (ew *EmailWatcher) loadToken() error {
-	// Get the token file path
-	tokenPath, err := getTokenFilePath()
-	if err != nil {
-		return fmt.Errorf("could not determine token file path: %v", err)
-	}
-
-	// Try to read the token file
-	tokenFile, err := os.ReadFile(tokenPath)
+	token, err := ew.tokenStore.Load()
 	if err != nil {
-		return fmt.Errorf("could not read token file %s: %v", tokenPath, err)
-	}
-
-	// Unmarshal the token
-	var token oauth2.Token
-	if err := json.Unmarshal(tokenFile, &token); err != nil {
-		return fmt.Errorf("could not parse token: %v", err)
+		return fmt.Errorf("could not load token: %v", err)
 	}
 
 	// Check if the token is expired and can be refreshed
-	tokenSource := ew.config.TokenSource(context.Background(), &token)
+	tokenSource := ew.config.TokenSource(context.Background(), token)
 	refreshedToken, err := tokenSource.Token()
 	if err != nil {
 		return fmt.Errorf("could not refresh token: %v", err)
 	}
+	if refreshedToken.AccessToken != token.AccessToken {
+		tokenRefreshTotal.Inc()
+	}
 
 	ew.token = refreshedToken
 	return nil
 }
 
-// saveToken saves the token to a file
+// saveToken saves the token via ew.tokenStore
 func (ew *EmailWatcher) saveToken() error {
-	// Get the token file path
-	tokenPath, err := getTokenFilePath()
-	if err != nil {
-		return fmt.Errorf("could not determine token file path: %v", err)
-	}
-
-	// Marshal the token to JSON
-	tokenJSON, err := json.MarshalIndent(ew.token, "", "  ")
-	if err != nil {
-		return fmt.Errorf("could not marshal token: %v", err)
+	if err := ew.tokenStore.Save(ew.token); err != nil {
+		return fmt.Errorf("could not save token: %v", err)
 	}
 
-	// Write the token to file with restricted permissions
-	if err := os.WriteFile(tokenPath, tokenJSON, 0600); err != nil {
-		return fmt.Errorf("could not write token file %s: %v", tokenPath, err)
-	}
-
-	log.Printf("Token saved to %s", tokenPath)
+	log.Println("Token saved")
 	return nil
 }
 
@@ -148,20 +142,16 @@ func (ew *EmailWatcher) authenticate() error {
 		return nil
 	}
 
-	// Log the error for debugging, but proceed with manual authentication
+	// Log the error for debugging, but proceed with interactive authentication
 	log.Printf("Could not load existing token: %v", err)
 
-	// If loading token fails, proceed with manual authentication
-	authURL := ew.config.AuthCodeURL("state", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser: %v\n", authURL)
-	fmt.Print("Enter authorization code: ")
-	var code string
-	fmt.Scanln(&code)
-
-	// Exchange authorization code for token
-	token, err := ew.config.Exchange(context.Background(), code)
+	// If loading token fails, run the loopback OAuth flow: this opens the
+	// browser and captures the authorization code via a local HTTP server,
+	// since Google is deprecating the "urn:ietf:wg:oauth:2.0:oob" flow that
+	// required pasting a code manually.
+	token, err := ew.authenticateLoopback()
 	if err != nil {
-		return fmt.Errorf("failed to exchange token: %v", err)
+		return fmt.Errorf("failed to authenticate: %v", err)
 	}
 
 	// Create Gmail service
@@ -180,64 +170,127 @@ func (ew *EmailWatcher) authenticate() error {
 	return nil
 }
 
-func (ew *EmailWatcher) saveLastProcessedEmailID(emailID string) error {
-	// Get the file path for storing last processed email ID
+// lastProcessedEmailFilePath returns the path to the file that persists both
+// the last processed email ID and the last processed Gmail historyId.
+func lastProcessedEmailFilePath() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return fmt.Errorf("could not get home directory: %v", err)
+		return "", fmt.Errorf("could not get home directory: %v", err)
+	}
+	return filepath.Join(homeDir, tokenSubdir, lastEmailIDFileName), nil
+}
+
+// loadState reads the persisted LastProcessedEmail state, returning a zero
+// value if no state has been saved yet.
+func loadState() (LastProcessedEmail, error) {
+	var state LastProcessedEmail
+
+	filePath, err := lastProcessedEmailFilePath()
+	if err != nil {
+		return state, err
+	}
+
+	fileData, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("could not read last processed state file: %v", err)
+	}
+
+	if err := json.Unmarshal(fileData, &state); err != nil {
+		return state, fmt.Errorf("could not parse last processed state: %v", err)
+	}
+
+	return state, nil
+}
+
+// saveState writes the LastProcessedEmail state to disk.
+func saveState(state LastProcessedEmail) error {
+	filePath, err := lastProcessedEmailFilePath()
+	if err != nil {
+		return err
 	}
-	filePath := filepath.Join(homeDir, tokenSubdir, lastEmailIDFileName)
 
-	// Ensure the directory exists
 	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
 		return fmt.Errorf("could not create directory: %v", err)
 	}
 
-	// Create the struct to save
-	lastEmail := LastProcessedEmail{EmailID: emailID}
+	jsonData, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal last processed state: %v", err)
+	}
 
-	// Marshal to JSON
-	jsonData, err := json.MarshalIndent(lastEmail, "", "  ")
+	// Write to a temp file in the same directory and rename over the real
+	// path, so a concurrent reader (or a crash mid-write) never observes a
+	// partially-written state file.
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), lastEmailIDFileName+".tmp-*")
 	if err != nil {
-		return fmt.Errorf("could not marshal last email ID: %v", err)
+		return fmt.Errorf("could not create temp state file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.Write(jsonData); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("could not write temp state file: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("could not close temp state file: %v", err)
+	}
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		return fmt.Errorf("could not set permissions on temp state file: %v", err)
 	}
 
-	// Write to file
-	if err := os.WriteFile(filePath, jsonData, 0600); err != nil {
-		return fmt.Errorf("could not write last email ID file: %v", err)
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("could not write last processed state file: %v", err)
 	}
 
 	return nil
 }
 
-func (ew *EmailWatcher) loadLastProcessedEmailID() (string, error) {
-	// Get the file path for last processed email ID
-	homeDir, err := os.UserHomeDir()
+func (ew *EmailWatcher) saveLastProcessedEmailID(emailID string) error {
+	state, err := loadState()
 	if err != nil {
-		return "", fmt.Errorf("could not get home directory: %v", err)
+		log.Printf("Warning: could not load existing state before save: %v", err)
 	}
-	filePath := filepath.Join(homeDir, tokenSubdir, lastEmailIDFileName)
+	state.EmailID = emailID
+	return saveState(state)
+}
 
-	// Read the file
-	fileData, err := os.ReadFile(filePath)
+func (ew *EmailWatcher) loadLastProcessedEmailID() (string, error) {
+	state, err := loadState()
 	if err != nil {
-		// If file doesn't exist, it's not an error - just return empty string
-		if os.IsNotExist(err) {
-			return "", nil
-		}
-		return "", fmt.Errorf("could not read last email ID file: %v", err)
+		return "", err
 	}
+	return state.EmailID, nil
+}
 
-	// Unmarshal the JSON
-	var lastEmail LastProcessedEmail
-	if err := json.Unmarshal(fileData, &lastEmail); err != nil {
-		return "", fmt.Errorf("could not parse last email ID: %v", err)
+// saveHistoryID persists the last Gmail historyId processed via push
+// notifications, alongside the last processed email ID.
+func (ew *EmailWatcher) saveHistoryID(historyID uint64) error {
+	state, err := loadState()
+	if err != nil {
+		log.Printf("Warning: could not load existing state before save: %v", err)
 	}
+	state.HistoryID = historyID
+	return saveState(state)
+}
 
-	return lastEmail.EmailID, nil
+// loadHistoryID loads the last Gmail historyId processed via push
+// notifications, returning 0 if none has been saved yet.
+func (ew *EmailWatcher) loadHistoryID() (uint64, error) {
+	state, err := loadState()
+	if err != nil {
+		return 0, err
+	}
+	return state.HistoryID, nil
 }
 
-func (ew *EmailWatcher) watchEmails() error {
+// watchEmailsWith polls for unread messages and invokes handler for each new
+// one. This is what lets GmailBackend and PushWatcher's resync path plug into
+// the same Backend.Watch contract.
+func (ew *EmailWatcher) watchEmailsWith(handler MessageHandler) error {
 	// Load the last processed email ID
 	lastProcessedEmailID, err := ew.loadLastProcessedEmailID()
 	if err != nil {
@@ -259,27 +312,12 @@ func (ew *EmailWatcher) watchEmails() error {
 			break
 		}
 
-		// Fetch full message details
-		msg, err := ew.service.Users.Messages.Get(user, m.Id).Do()
-		if err != nil {
-			log.Printf("Error fetching message %s: %v", m.Id, err)
+		// Fetch and process the message
+		if err := ew.fetchAndProcessMessage(m.Id, handler); err != nil {
+			log.Printf("Error processing message %s: %v", m.Id, err)
 			continue
 		}
 
-		// Extract sender and subject
-		var from, subject string
-		for _, header := range msg.Payload.Headers {
-			switch header.Name {
-			case "From":
-				from = header.Value
-			case "Subject":
-				subject = header.Value
-			}
-		}
-
-		// Process the message
-		ew.processMessage(from, subject)
-
 		// Update last processed email ID after successful processing
 		if err := ew.saveLastProcessedEmailID(m.Id); err != nil {
 			log.Printf("Warning: Could not save last processed email ID: %v", err)
@@ -297,44 +335,147 @@ func (ew *EmailWatcher) watchEmails() error {
 	return nil
 }
 
-func (ew *EmailWatcher) processMessage(from, subject string) {
-	log.Printf("New email from %s with subject: %s", from, subject)
+// fetchAndProcessMessage fetches a single message by ID, builds its
+// EmailContext, and runs it through handler. It is shared by the polling
+// (watchEmailsWith) and push (PushWatcher) code paths.
+func (ew *EmailWatcher) fetchAndProcessMessage(messageID string, handler MessageHandler) error {
+	logger := slog.With("msg_id", messageID)
 
-	// Example processing logic
-	switch {
-	case strings.Contains(strings.ToLower(from), "github.com"):
-		log.Println("GitHub notification detected")
-		// Example: Send a notification or log GitHub-related emails
-		// You could add logic to parse GitHub email contents, track issues, etc.
+	fetchStart := time.Now()
+	msg, err := ew.service.Users.Messages.Get("me", messageID).Do()
+	observeSince(gmailAPILatencySeconds, fetchStart)
+	if err != nil {
+		apiErrorsTotal.WithLabelValues("gmail").Inc()
+		return fmt.Errorf("unable to fetch message: %v", err)
+	}
 
-	case strings.Contains(strings.ToLower(subject), "invoice"):
-		log.Println("Invoice email detected")
-		// Example: Save invoice to a specific folder or trigger accounting workflow
-		// You might want to download attachments or extract invoice details
+	parsed, err := parseMessage(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("unable to parse message body: %v", err)
+	}
 
-	case strings.Contains(strings.ToLower(from), "urgent@company.com"):
-		log.Println("Urgent company email received")
-		// Example: Send an immediate notification via SMS or push notification
-		ew.sendUrgentNotification(from, subject)
+	body := parsed.TextBody
+	if body == "" {
+		body = parsed.HTMLBody
+	}
 
-	default:
-		log.Println("Regular email received")
+	ctx := EmailContext{
+		Headers:       make(map[string]string, len(msg.Payload.Headers)),
+		Labels:        msg.LabelIds,
+		HasAttachment: len(parsed.Attachments) > 0,
+		Body:          body,
+		Attachments:   parsed.Attachments,
+		FetchAttachment: func(attachment Attachment) ([]byte, error) {
+			return fetchAttachmentData(ew.service, messageID, attachment)
+		},
+	}
+	for _, header := range msg.Payload.Headers {
+		ctx.Headers[header.Name] = header.Value
+		switch header.Name {
+		case "From":
+			ctx.From = header.Value
+		case "Subject":
+			ctx.Subject = header.Value
+		}
 	}
+
+	logger.Info("processing message", "from", ctx.From, "subject", ctx.Subject, "attachments", len(ctx.Attachments))
+	handler(ctx)
+	emailsProcessedTotal.Inc()
+	return nil
 }
 
-// Example helper function for sending urgent notifications
-func (ew *EmailWatcher) sendUrgentNotification(from, subject string) {
-	// Placeholder for sending urgent notifications
-	// In a real-world scenario, you might:
-	// - Send an SMS
-	// - Push notification to a mobile app
-	// - Send a Slack/Discord message
-	log.Printf("URGENT: Email from %s with subject '%s' requires immediate attention!", from, subject)
+// defaultProcessMessage is the MessageHandler used when no rule engine is
+// configured, preserving the previous behavior of simply logging the
+// message.
+func defaultProcessMessage(ctx EmailContext) {
+	log.Printf("New email from %s with subject: %s", ctx.From, ctx.Subject)
 }
 
 func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	tokenStoreKind := flag.String("token-store", os.Getenv("TOKEN_STORE"), "where to persist the Gmail OAuth token: file, keyring, or encrypted-file")
+	flag.Parse()
+
+	// The root context is cancelled on SIGINT/SIGTERM so every backend and
+	// the daemon HTTP server get a chance to shut down gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	metricsAddr := os.Getenv("METRICS_LISTEN_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = ":9090"
+	}
+	go serveDaemonHTTP(ctx, metricsAddr)
+
+	handler := loadMessageHandler()
+
+	// EMAIL_BACKEND selects the mail source: "gmail" (default) or "imap", for
+	// users on Fastmail/Proton Bridge/self-hosted mail.
+	if os.Getenv("EMAIL_BACKEND") == "imap" {
+		runIMAPBackend(ctx, handler)
+		return
+	}
+
+	runGmailBackend(ctx, handler, *tokenStoreKind)
+}
+
+// loadMessageHandler loads the rule file named by RULES_FILE (or
+// ~/.config/ai-thing/rules.yaml) and returns a MessageHandler backed by it.
+// If no rule file is found, it falls back to defaultProcessMessage.
+func loadMessageHandler() MessageHandler {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			log.Printf("Warning: could not determine home directory for rules file: %v", err)
+			return defaultProcessMessage
+		}
+		path = filepath.Join(homeDir, rulesSubdir, rulesFileName)
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("No rule file found at %s; using default message handling", path)
+		return defaultProcessMessage
+	}
+
+	engine, err := loadRuleEngine(path)
+	if err != nil {
+		log.Printf("Warning: could not load rule file %s: %v; using default message handling", path, err)
+		return defaultProcessMessage
+	}
+
+	engine.watchReloadSignal()
+	return engine.Evaluate
+}
+
+// runIMAPBackend authenticates and watches a plain IMAP mailbox via IDLE
+// until ctx is cancelled.
+func runIMAPBackend(ctx context.Context, handler MessageHandler) {
+	config, err := loadIMAPConfig()
+	if err != nil {
+		log.Fatalf("Could not load IMAP configuration: %v", err)
+	}
+
+	backend := newIMAPBackend(config)
+	if err := backend.Authenticate(); err != nil {
+		log.Fatalf("IMAP authentication error: %v", err)
+	}
+	daemonHealth.setReady(true)
+
+	slog.Info("starting IMAP watcher")
+	if err := backend.Watch(ctx, handler); err != nil && ctx.Err() == nil {
+		log.Fatalf("Error watching IMAP mailbox: %v", err)
+	}
+	slog.Info("IMAP watcher stopped")
+}
+
+// runGmailBackend authenticates and watches Gmail, via push notifications if
+// configured or polling otherwise, until ctx is cancelled.
+func runGmailBackend(ctx context.Context, handler MessageHandler, tokenStoreKind string) {
 	// Create email watcher
-	watcher, err := newEmailWatcher()
+	watcher, err := newEmailWatcher(tokenStoreKind)
 	if err != nil {
 		log.Fatalf("Failed to create email watcher: %v", err)
 	}
@@ -343,10 +484,56 @@ func main() {
 	if err := watcher.authenticate(); err != nil {
 		log.Fatalf("Authentication error: %v", err)
 	}
+	daemonHealth.setTokenExpiry(watcher.token.Expiry)
+
+	// If a Pub/Sub topic is configured, use near-real-time push notifications
+	// instead of polling.
+	if topicName := os.Getenv("GMAIL_PUBSUB_TOPIC"); topicName != "" {
+		pushWatcher := newPushWatcher(watcher, topicName, handler)
+
+		historyID, err := pushWatcher.startWatch()
+		if err != nil {
+			log.Fatalf("Error registering Gmail watch: %v", err)
+		}
+		if err := watcher.saveHistoryID(historyID); err != nil {
+			log.Printf("Warning: Could not save initial historyId: %v", err)
+		}
+		daemonHealth.recordSync()
+
+		stopRenew := make(chan struct{})
+		go pushWatcher.renewLoop(stopRenew)
+		defer close(stopRenew)
+
+		addr := os.Getenv("GMAIL_PUSH_LISTEN_ADDR")
+		if addr == "" {
+			addr = ":8080"
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(pushWebhookPath, pushWatcher.handlePush)
+		server := &http.Server{Addr: addr, Handler: mux}
+
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
+
+		daemonHealth.setReady(true)
+		slog.Info("listening for Gmail push notifications", "addr", addr, "path", pushWebhookPath)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("push webhook server error: %v", err)
+		}
+		return
+	}
 
-	// Start watching emails
-	log.Println("Starting email watcher. Press Ctrl+C to stop.")
-	if err := watcher.watchEmails(); err != nil {
+	// Otherwise, fall back to the polling loop.
+	daemonHealth.setReady(true)
+	slog.Info("starting Gmail poll loop")
+	backend := newGmailBackend(watcher)
+	if err := backend.Watch(ctx, handler); err != nil && ctx.Err() == nil {
 		log.Fatalf("Error watching emails: %v", err)
 	}
+	slog.Info("Gmail poll loop stopped")
 }
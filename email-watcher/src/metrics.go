@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	emailsProcessedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "emails_processed_total",
+		Help: "Total number of emails successfully processed by a message handler.",
+	})
+
+	apiErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_errors_total",
+		Help: "Total number of errors returned by a mail backend, by backend name.",
+	}, []string{"backend"})
+
+	tokenRefreshTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "token_refresh_total",
+		Help: "Total number of OAuth token refreshes.",
+	})
+
+	gmailAPILatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gmail_api_latency_seconds",
+		Help:    "Latency of Gmail API calls made to fetch a single message.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	ruleActionLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rule_action_latency_seconds",
+		Help:    "Latency of rule action execution, by action type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"action"})
+)
+
+// observeSince records the elapsed time since start against h. It's meant to
+// be used with defer: `defer observeSince(gmailAPILatencySeconds, time.Now())`.
+func observeSince(h prometheus.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// ParsedEmail is the normalized, decoded form of a Gmail message body,
+// independent of how deeply MIME nested the text and attachment parts.
+type ParsedEmail struct {
+	TextBody    string
+	HTMLBody    string
+	Attachments []Attachment
+}
+
+// Attachment describes a MIME part with a filename. It holds only metadata:
+// the content is retrieved on demand by fetchAttachmentData, which fails for
+// an attachment with an empty AttachmentID.
+type Attachment struct {
+	Filename     string
+	MimeType     string
+	AttachmentID string
+	PartID       string
+}
+
+// parseMessage walks payload recursively, decoding each leaf part's body
+// according to its Content-Type, Content-Transfer-Encoding, and charset.
+func parseMessage(payload *gmail.MessagePart) (*ParsedEmail, error) {
+	parsed := &ParsedEmail{}
+	if err := walkMessagePart(payload, parsed); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func walkMessagePart(part *gmail.MessagePart, parsed *ParsedEmail) error {
+	if part == nil {
+		return nil
+	}
+
+	if part.Filename != "" {
+		attachment := Attachment{
+			Filename: part.Filename,
+			MimeType: part.MimeType,
+			PartID:   part.PartId,
+		}
+		if part.Body != nil {
+			attachment.AttachmentID = part.Body.AttachmentId
+		}
+		parsed.Attachments = append(parsed.Attachments, attachment)
+		return nil
+	}
+
+	if len(part.Parts) > 0 {
+		for _, child := range part.Parts {
+			if err := walkMessagePart(child, parsed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if part.Body == nil || part.Body.Data == "" {
+		return nil
+	}
+
+	raw, err := decodeBase64URL(part.Body.Data)
+	if err != nil {
+		return fmt.Errorf("could not base64url-decode part %s: %v", part.PartId, err)
+	}
+
+	decoded, err := decodeTransferEncoding(raw, headerValue(part.Headers, "Content-Transfer-Encoding"))
+	if err != nil {
+		return fmt.Errorf("could not decode transfer encoding for part %s: %v", part.PartId, err)
+	}
+
+	text, err := decodeCharset(decoded, part.MimeType)
+	if err != nil {
+		return fmt.Errorf("could not decode charset for part %s: %v", part.PartId, err)
+	}
+
+	switch {
+	case strings.HasPrefix(part.MimeType, "text/html"):
+		parsed.HTMLBody += text
+	case strings.HasPrefix(part.MimeType, "text/plain"):
+		parsed.TextBody += text
+	}
+
+	return nil
+}
+
+// decodeBase64URL decodes Gmail's base64url body data, which is commonly
+// sent without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	if data, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return data, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// decodeTransferEncoding undoes quoted-printable or base64 Content-Transfer-
+// Encoding, leaving the data untouched for anything else (including the
+// common case where Gmail has already normalized it for us).
+func decodeTransferEncoding(data []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	case "base64":
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(data))
+		if err != nil {
+			return nil, err
+		}
+		return decoded[:n], nil
+	default:
+		return data, nil
+	}
+}
+
+// decodeCharset converts data from the charset named in mimeType's
+// Content-Type parameters to UTF-8. An unrecognized or absent charset falls
+// back to treating data as-is rather than failing the whole message.
+func decodeCharset(data []byte, mimeType string) (string, error) {
+	_, params, err := mime.ParseMediaType(mimeType)
+	if err != nil || params["charset"] == "" {
+		return string(data), nil
+	}
+
+	enc, err := htmlindex.Get(params["charset"])
+	if err != nil {
+		return string(data), nil
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("could not decode charset %q: %v", params["charset"], err)
+	}
+
+	return string(decoded), nil
+}
+
+func headerValue(headers []*gmail.MessagePartHeader, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// fetchAttachmentData retrieves an attachment's bytes via
+// Users.Messages.Attachments.Get.
+func fetchAttachmentData(service *gmail.Service, messageID string, attachment Attachment) ([]byte, error) {
+	if attachment.AttachmentID == "" {
+		return nil, fmt.Errorf("attachment %s has no attachmentId to fetch", attachment.Filename)
+	}
+
+	resp, err := service.Users.Messages.Attachments.Get("me", messageID, attachment.AttachmentID).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch attachment %s: %v", attachment.Filename, err)
+	}
+
+	return decodeBase64URL(resp.Data)
+}
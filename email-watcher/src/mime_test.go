@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func headerPart(name, value string) *gmail.MessagePartHeader {
+	return &gmail.MessagePartHeader{Name: name, Value: value}
+}
+
+func TestParseMessagePlainText(t *testing.T) {
+	payload := &gmail.MessagePart{
+		MimeType: "text/plain",
+		Body: &gmail.MessagePartBody{
+			Data: base64.RawURLEncoding.EncodeToString([]byte("hello world")),
+		},
+	}
+
+	parsed, err := parseMessage(payload)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if parsed.TextBody != "hello world" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "hello world")
+	}
+}
+
+func TestParseMessageQuotedPrintable(t *testing.T) {
+	// "café" quoted-printable encoded as raw (pre-base64url) bytes.
+	raw := []byte("caf=C3=A9")
+	payload := &gmail.MessagePart{
+		MimeType: "text/plain; charset=utf-8",
+		Headers:  []*gmail.MessagePartHeader{headerPart("Content-Transfer-Encoding", "quoted-printable")},
+		Body: &gmail.MessagePartBody{
+			Data: base64.RawURLEncoding.EncodeToString(raw),
+		},
+	}
+
+	parsed, err := parseMessage(payload)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if parsed.TextBody != "café" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "café")
+	}
+}
+
+func TestParseMessageNonUTF8Charset(t *testing.T) {
+	// "café" encoded as ISO-8859-1 (0xE9 is é).
+	raw := []byte{'c', 'a', 'f', 0xE9}
+	payload := &gmail.MessagePart{
+		MimeType: "text/plain; charset=iso-8859-1",
+		Body: &gmail.MessagePartBody{
+			Data: base64.RawURLEncoding.EncodeToString(raw),
+		},
+	}
+
+	parsed, err := parseMessage(payload)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if parsed.TextBody != "café" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "café")
+	}
+}
+
+func TestParseMessageMultipartWithAttachment(t *testing.T) {
+	payload := &gmail.MessagePart{
+		MimeType: "multipart/mixed",
+		Parts: []*gmail.MessagePart{
+			{
+				MimeType: "text/plain",
+				Body: &gmail.MessagePartBody{
+					Data: base64.RawURLEncoding.EncodeToString([]byte("see attached invoice")),
+				},
+			},
+			{
+				MimeType: "application/pdf",
+				Filename: "invoice.pdf",
+				PartId:   "2",
+				Body: &gmail.MessagePartBody{
+					AttachmentId: "attachment-123",
+					Size:         4096,
+				},
+			},
+		},
+	}
+
+	parsed, err := parseMessage(payload)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if parsed.TextBody != "see attached invoice" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "see attached invoice")
+	}
+	if len(parsed.Attachments) != 1 {
+		t.Fatalf("len(Attachments) = %d, want 1", len(parsed.Attachments))
+	}
+	attachment := parsed.Attachments[0]
+	if attachment.Filename != "invoice.pdf" || attachment.MimeType != "application/pdf" || attachment.AttachmentID != "attachment-123" {
+		t.Errorf("unexpected attachment: %+v", attachment)
+	}
+}
+
+func TestHasAttachmentMimeType(t *testing.T) {
+	attachments := []Attachment{{MimeType: "application/pdf"}, {MimeType: "image/png"}}
+
+	if !hasAttachmentMimeType(attachments, "application/pdf") {
+		t.Error("expected application/pdf to match")
+	}
+	if hasAttachmentMimeType(attachments, "text/csv") {
+		t.Error("did not expect text/csv to match")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// authResult carries the outcome of the loopback OAuth callback.
+type authResult struct {
+	code string
+	err  error
+}
+
+// authenticateLoopback performs the OAuth 2.0 authorization code flow using a
+// loopback redirect (http://127.0.0.1:<port>/callback) instead of the
+// deprecated "urn:ietf:wg:oauth:2.0:oob" out-of-band flow, which Google is
+// phasing out. It binds an ephemeral local port, opens the authorization URL
+// in the user's browser, and waits for the browser to redirect back with the
+// authorization code.
+func (ew *EmailWatcher) authenticateLoopback() (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not start loopback listener: %v", err)
+	}
+
+	state, err := randomState()
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not generate state: %v", err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	ew.config.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/callback", port)
+
+	resultCh := make(chan authResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			resultCh <- authResult{err: fmt.Errorf("state mismatch: possible CSRF attempt")}
+			return
+		}
+
+		if errParam := query.Get("error"); errParam != "" {
+			http.Error(w, "authorization failed", http.StatusBadRequest)
+			resultCh <- authResult{err: fmt.Errorf("authorization denied: %s", errParam)}
+			return
+		}
+
+		code := query.Get("code")
+		if code == "" {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			resultCh <- authResult{err: fmt.Errorf("callback did not include an authorization code")}
+			return
+		}
+
+		fmt.Fprintln(w, "Authentication complete. You can close this tab and return to the terminal.")
+		resultCh <- authResult{code: code}
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("loopback callback server error: %v", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error shutting down loopback callback server: %v", err)
+		}
+	}()
+
+	authURL := ew.config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Opening browser for authorization. If it doesn't open, go to:\n%v\n", authURL)
+	if err := openBrowser(authURL); err != nil {
+		log.Printf("could not open browser automatically: %v", err)
+	}
+
+	result := <-resultCh
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	token, err := ew.config.Exchange(context.Background(), result.code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange token: %v", err)
+	}
+
+	return token, nil
+}
+
+// randomState generates a CSRF-safe random state value for the OAuth flow.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// openBrowser opens url in the user's default browser across platforms.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
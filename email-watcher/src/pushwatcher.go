@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	watchRenewalInterval = 24 * time.Hour
+	pushWebhookPath       = "/gmail/push"
+)
+
+// PushWatcher replaces poll-and-diff with Gmail's Cloud Pub/Sub push
+// notifications: it registers a watch on the mailbox, receives a webhook for
+// every change, and walks the history feed to fetch only what's new since the
+// last processed historyId.
+type PushWatcher struct {
+	ew          *EmailWatcher
+	topicName   string
+	labelFilter []string
+	handler     MessageHandler
+
+	// historyMu serializes processHistory, since Pub/Sub can and does
+	// deliver pushes for distinct notifications concurrently, and the
+	// underlying historyId/last-processed state is not safe for concurrent
+	// read-modify-write.
+	historyMu sync.Mutex
+}
+
+// newPushWatcher builds a PushWatcher for the given Cloud Pub/Sub topic, e.g.
+// "projects/my-project/topics/gmail-push". Every new message discovered is
+// passed to handler.
+func newPushWatcher(ew *EmailWatcher, topicName string, handler MessageHandler) *PushWatcher {
+	return &PushWatcher{
+		ew:          ew,
+		topicName:   topicName,
+		labelFilter: []string{"INBOX"},
+		handler:     handler,
+	}
+}
+
+// pubsubPushEnvelope is the JSON body Cloud Pub/Sub POSTs to a push
+// subscription's endpoint.
+type pubsubPushEnvelope struct {
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// gmailPushNotification is the payload Gmail base64-encodes into the Pub/Sub
+// message's Data field.
+type gmailPushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// startWatch registers (or renews) the mailbox watch with Gmail and returns
+// the historyId it was registered at.
+func (pw *PushWatcher) startWatch() (uint64, error) {
+	req := &gmail.WatchRequest{
+		TopicName: pw.topicName,
+		LabelIds:  pw.labelFilter,
+	}
+
+	resp, err := pw.ew.service.Users.Watch("me", req).Do()
+	if err != nil {
+		return 0, fmt.Errorf("unable to register Gmail watch: %v", err)
+	}
+
+	log.Printf("Gmail watch registered on topic %s, expires %s", pw.topicName, time.UnixMilli(resp.Expiration).Format(time.RFC3339))
+	return resp.HistoryId, nil
+}
+
+// renewLoop re-registers the watch roughly once a day, since Gmail watches
+// expire after at most 7 days and push delivery is otherwise silent about it.
+func (pw *PushWatcher) renewLoop(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(watchRenewalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := pw.startWatch(); err != nil {
+				log.Printf("Warning: could not renew Gmail watch: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// handlePush is the HTTP handler for the Pub/Sub push subscription endpoint.
+func (pw *PushWatcher) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	var envelope pubsubPushEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, "malformed push envelope", http.StatusBadRequest)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(envelope.Message.Data)
+	if err != nil {
+		http.Error(w, "malformed message data", http.StatusBadRequest)
+		return
+	}
+
+	var notification gmailPushNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		http.Error(w, "malformed notification payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := pw.processHistory(notification.HistoryID); err != nil {
+		log.Printf("Error processing history up to %d: %v", notification.HistoryID, err)
+		// Acknowledge anyway: Pub/Sub will redeliver on non-2xx, but a
+		// processing error here is almost always not transient.
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// processHistory fetches everything that happened since the last processed
+// historyId and feeds new messages into pw.handler. If the history has
+// expired on Gmail's side, it falls back to a full resync.
+func (pw *PushWatcher) processHistory(newHistoryID uint64) error {
+	pw.historyMu.Lock()
+	defer pw.historyMu.Unlock()
+
+	lastHistoryID, err := pw.ew.loadHistoryID()
+	if err != nil {
+		log.Printf("Warning: could not load last historyId: %v", err)
+	}
+
+	if lastHistoryID == 0 {
+		log.Println("No prior historyId on record; performing full resync")
+		return pw.fullResync(newHistoryID)
+	}
+
+	// Pub/Sub push delivery is at-least-once and unordered, so this
+	// notification may be a stale duplicate of one we've already advanced
+	// past (including one redelivered because a slow rule action blew past
+	// the ack deadline). Treat anything at or behind our high-water mark as
+	// already handled instead of re-running every rule action.
+	if newHistoryID <= lastHistoryID {
+		log.Printf("Ignoring stale push notification: historyId %d already processed (last %d)", newHistoryID, lastHistoryID)
+		return nil
+	}
+
+	user := "me"
+	call := pw.ew.service.Users.History.List(user).StartHistoryId(lastHistoryID).HistoryTypes("messageAdded")
+
+	var processed int
+	highWaterMark := lastHistoryID
+	err = call.Pages(context.Background(), func(page *gmail.ListHistoryResponse) error {
+		for _, h := range page.History {
+			for _, added := range h.MessagesAdded {
+				if err := pw.ew.fetchAndProcessMessage(added.Message.Id, pw.handler); err != nil {
+					log.Printf("Error processing message %s: %v", added.Message.Id, err)
+					continue
+				}
+				processed++
+			}
+		}
+		if page.HistoryId > highWaterMark {
+			highWaterMark = page.HistoryId
+		}
+		return nil
+	})
+
+	if err != nil {
+		if isHistoryExpired(err) {
+			log.Println("History expired on Gmail's side; falling back to full resync")
+			return pw.fullResync(newHistoryID)
+		}
+		return fmt.Errorf("unable to list history since %d: %v", lastHistoryID, err)
+	}
+
+	// The notification's historyId is itself a lower bound on how current
+	// the mailbox is, even if no page happened to report HistoryId.
+	if newHistoryID > highWaterMark {
+		highWaterMark = newHistoryID
+	}
+
+	log.Printf("Processed %d new message(s) via push notification", processed)
+	daemonHealth.recordSync()
+	return pw.ew.saveHistoryID(highWaterMark)
+}
+
+// fullResync re-derives state from scratch when Gmail can no longer serve
+// history starting at our last known historyId (history retention expired).
+func (pw *PushWatcher) fullResync(newHistoryID uint64) error {
+	if err := pw.ew.watchEmailsWith(pw.handler); err != nil {
+		return fmt.Errorf("full resync failed: %v", err)
+	}
+	return pw.ew.saveHistoryID(newHistoryID)
+}
+
+// isHistoryExpired reports whether err indicates Gmail can no longer serve
+// history starting at the requested historyId (HTTP 404).
+func isHistoryExpired(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultActionTimeout = 10 * time.Second
+	defaultActionRetries = 2
+)
+
+// EmailContext carries everything a rule's match predicates and actions need
+// about a single message.
+type EmailContext struct {
+	From          string
+	Subject       string
+	Headers       map[string]string
+	Labels        []string
+	HasAttachment bool
+	Body          string
+	Attachments   []Attachment
+
+	// FetchAttachment retrieves the content of one of Attachments, fetching it
+	// from Gmail on demand. It is nil for backends that don't support fetching
+	// attachment content (e.g. IMAP today).
+	FetchAttachment func(Attachment) ([]byte, error)
+}
+
+// MatchConditions describes the predicates a rule must satisfy against an
+// EmailContext. An empty MatchConditions matches everything.
+type MatchConditions struct {
+	FromRegex          string            `yaml:"from_regex,omitempty" json:"from_regex,omitempty"`
+	SubjectRegex       string            `yaml:"subject_regex,omitempty" json:"subject_regex,omitempty"`
+	BodyRegex          string            `yaml:"body_regex,omitempty" json:"body_regex,omitempty"`
+	HasLabel           string            `yaml:"has_label,omitempty" json:"has_label,omitempty"`
+	Headers            map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	HasAttachment      *bool             `yaml:"has_attachment,omitempty" json:"has_attachment,omitempty"`
+	AttachmentMimeType string            `yaml:"attachment_mime_type,omitempty" json:"attachment_mime_type,omitempty"`
+
+	fromRegexp    *regexp.Regexp
+	subjectRegexp *regexp.Regexp
+	bodyRegexp    *regexp.Regexp
+	headerRegexps map[string]*regexp.Regexp
+}
+
+// compile pre-compiles the regexes in m so Evaluate doesn't pay that cost per
+// message.
+func (m *MatchConditions) compile() error {
+	if m.FromRegex != "" {
+		re, err := regexp.Compile(m.FromRegex)
+		if err != nil {
+			return fmt.Errorf("invalid from_regex %q: %v", m.FromRegex, err)
+		}
+		m.fromRegexp = re
+	}
+
+	if m.SubjectRegex != "" {
+		re, err := regexp.Compile(m.SubjectRegex)
+		if err != nil {
+			return fmt.Errorf("invalid subject_regex %q: %v", m.SubjectRegex, err)
+		}
+		m.subjectRegexp = re
+	}
+
+	if m.BodyRegex != "" {
+		re, err := regexp.Compile(m.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("invalid body_regex %q: %v", m.BodyRegex, err)
+		}
+		m.bodyRegexp = re
+	}
+
+	if len(m.Headers) > 0 {
+		m.headerRegexps = make(map[string]*regexp.Regexp, len(m.Headers))
+		for name, pattern := range m.Headers {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid header regex for %q: %v", name, err)
+			}
+			m.headerRegexps[name] = re
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether ctx satisfies every predicate in m.
+func (m *MatchConditions) matches(ctx EmailContext) bool {
+	if m.fromRegexp != nil && !m.fromRegexp.MatchString(ctx.From) {
+		return false
+	}
+	if m.subjectRegexp != nil && !m.subjectRegexp.MatchString(ctx.Subject) {
+		return false
+	}
+	if m.bodyRegexp != nil && !m.bodyRegexp.MatchString(ctx.Body) {
+		return false
+	}
+	if m.HasLabel != "" && !containsLabel(ctx.Labels, m.HasLabel) {
+		return false
+	}
+	if m.HasAttachment != nil && *m.HasAttachment != ctx.HasAttachment {
+		return false
+	}
+	if m.AttachmentMimeType != "" && !hasAttachmentMimeType(ctx.Attachments, m.AttachmentMimeType) {
+		return false
+	}
+	for name, re := range m.headerRegexps {
+		value, ok := ctx.Headers[name]
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttachmentMimeType(attachments []Attachment, mimeType string) bool {
+	for _, a := range attachments {
+		if a.MimeType == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Action is a single step a matching rule performs. Only the fields relevant
+// to Type need to be set.
+type Action struct {
+	Type    string        `yaml:"type" json:"type"`
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Retries int           `yaml:"retries,omitempty" json:"retries,omitempty"`
+
+	// log
+	Message string `yaml:"message,omitempty" json:"message,omitempty"`
+
+	// slack_webhook, http_post
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+
+	// exec
+	Command string   `yaml:"command,omitempty" json:"command,omitempty"`
+	Args    []string `yaml:"args,omitempty" json:"args,omitempty"`
+
+	// forward
+	SMTPAddr string   `yaml:"smtp_addr,omitempty" json:"smtp_addr,omitempty"`
+	From     string   `yaml:"from,omitempty" json:"from,omitempty"`
+	To       []string `yaml:"to,omitempty" json:"to,omitempty"`
+
+	// save_attachment
+	Directory string `yaml:"directory,omitempty" json:"directory,omitempty"`
+	MimeType  string `yaml:"mime_type,omitempty" json:"mime_type,omitempty"`
+}
+
+// Rule pairs match predicates with the actions to run when they're all
+// satisfied.
+type Rule struct {
+	Name    string          `yaml:"name" json:"name"`
+	Match   MatchConditions `yaml:"match" json:"match"`
+	Actions []Action        `yaml:"actions" json:"actions"`
+}
+
+// RuleEngine evaluates incoming messages against a hot-reloadable set of
+// rules, replacing the hard-coded switch that used to live in
+// EmailWatcher.processMessage.
+type RuleEngine struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// loadRuleEngine reads and compiles the rule file at path.
+func loadRuleEngine(path string) (*RuleEngine, error) {
+	engine := &RuleEngine{path: path}
+	if err := engine.reload(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// reload re-reads the rule file from disk and atomically swaps in the new
+// rule set. An error leaves the previously loaded rules in place.
+func (re *RuleEngine) reload() error {
+	data, err := os.ReadFile(re.path)
+	if err != nil {
+		return fmt.Errorf("could not read rule file %s: %v", re.path, err)
+	}
+
+	var rules []Rule
+	if strings.HasSuffix(re.path, ".json") {
+		err = json.Unmarshal(data, &rules)
+	} else {
+		err = yaml.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse rule file %s: %v", re.path, err)
+	}
+
+	for i := range rules {
+		if err := rules[i].Match.compile(); err != nil {
+			return fmt.Errorf("rule %q: %v", rules[i].Name, err)
+		}
+	}
+
+	re.mu.Lock()
+	re.rules = rules
+	re.mu.Unlock()
+
+	log.Printf("Loaded %d rule(s) from %s", len(rules), re.path)
+	return nil
+}
+
+// watchReloadSignal hot-reloads the rule file whenever the process receives
+// SIGHUP.
+func (re *RuleEngine) watchReloadSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for range sigCh {
+			log.Println("Received SIGHUP, reloading rules")
+			if err := re.reload(); err != nil {
+				log.Printf("Warning: could not reload rules: %v", err)
+			}
+		}
+	}()
+}
+
+// Evaluate runs every rule whose match predicates are satisfied by ctx,
+// executing their actions in order.
+func (re *RuleEngine) Evaluate(ctx EmailContext) {
+	re.mu.RLock()
+	rules := re.rules
+	re.mu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.Match.matches(ctx) {
+			continue
+		}
+
+		for _, action := range rule.Actions {
+			if err := runActionWithRetry(action, ctx); err != nil {
+				log.Printf("Rule %q: action %q failed: %v", rule.Name, action.Type, err)
+			}
+		}
+	}
+}
+
+// runActionWithRetry runs action with a linearly growing delay between
+// attempts (1s, 2s, ...) and a per-attempt timeout.
+func runActionWithRetry(action Action, email EmailContext) error {
+	retries := action.Retries
+	if retries <= 0 {
+		retries = defaultActionRetries
+	}
+
+	timeout := action.Timeout
+	if timeout <= 0 {
+		timeout = defaultActionTimeout
+	}
+
+	start := time.Now()
+	defer func() {
+		ruleActionLatencySeconds.WithLabelValues(action.Type).Observe(time.Since(start).Seconds())
+	}()
+
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		actionCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		lastErr = executeAction(actionCtx, action, email)
+		cancel()
+
+		if lastErr == nil {
+			return nil
+		}
+		log.Printf("action %q attempt %d/%d failed: %v", action.Type, attempt+1, retries+1, lastErr)
+	}
+
+	return lastErr
+}
+
+// executeAction dispatches to the handler for action.Type.
+func executeAction(ctx context.Context, action Action, email EmailContext) error {
+	switch action.Type {
+	case "log":
+		message := action.Message
+		if message == "" {
+			message = fmt.Sprintf("email from %s: %s", email.From, email.Subject)
+		}
+		log.Println(message)
+		return nil
+
+	case "slack_webhook":
+		return postJSON(ctx, action.URL, map[string]string{
+			"text": fmt.Sprintf("From: %s\nSubject: %s", email.From, email.Subject),
+		})
+
+	case "http_post":
+		return postJSON(ctx, action.URL, map[string]string{
+			"from":    email.From,
+			"subject": email.Subject,
+		})
+
+	case "exec":
+		return runExecAction(ctx, action, email)
+
+	case "forward":
+		return forwardViaSMTP(action, email)
+
+	case "save_attachment":
+		return saveAttachments(action, email)
+
+	default:
+		return fmt.Errorf("unknown action type %q", action.Type)
+	}
+}
+
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	if url == "" {
+		return fmt.Errorf("action requires a url")
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("request to %s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// runExecAction runs action.Command with FROM/SUBJECT/BODY available as
+// environment variables.
+func runExecAction(ctx context.Context, action Action, email EmailContext) error {
+	if action.Command == "" {
+		return fmt.Errorf("exec action requires a command")
+	}
+
+	cmd := exec.CommandContext(ctx, action.Command, action.Args...)
+	cmd.Env = append(os.Environ(),
+		"FROM="+email.From,
+		"SUBJECT="+email.Subject,
+		"BODY="+email.Body,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command failed: %v (output: %s)", err, output)
+	}
+	return nil
+}
+
+// forwardViaSMTP forwards the message to action.To via the SMTP server at
+// action.SMTPAddr.
+func forwardViaSMTP(action Action, email EmailContext) error {
+	if action.SMTPAddr == "" || len(action.To) == 0 {
+		return fmt.Errorf("forward action requires smtp_addr and to")
+	}
+
+	from := action.From
+	if from == "" {
+		from = "ai-thing@localhost"
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Fwd: %s\r\n\r\n%s\r\n",
+		from, strings.Join(action.To, ", "), email.Subject, email.Body)
+
+	return smtp.SendMail(action.SMTPAddr, nil, from, action.To, []byte(msg))
+}
+
+// saveAttachments fetches and writes every attachment on email matching
+// action.MimeType (all of them, if unset) to action.Directory.
+func saveAttachments(action Action, email EmailContext) error {
+	if action.Directory == "" {
+		return fmt.Errorf("save_attachment action requires a directory")
+	}
+	if err := os.MkdirAll(action.Directory, 0700); err != nil {
+		return fmt.Errorf("could not create attachment directory %s: %v", action.Directory, err)
+	}
+
+	var lastErr error
+	saved := 0
+	for _, attachment := range email.Attachments {
+		if action.MimeType != "" && attachment.MimeType != action.MimeType {
+			continue
+		}
+		if email.FetchAttachment == nil {
+			lastErr = fmt.Errorf("no attachment fetcher available for %s", attachment.Filename)
+			continue
+		}
+
+		data, err := email.FetchAttachment(attachment)
+		if err != nil {
+			lastErr = fmt.Errorf("could not fetch attachment %s: %v", attachment.Filename, err)
+			continue
+		}
+
+		// attachment.Filename comes straight from the sender's
+		// Content-Disposition header, so strip any directory components
+		// before joining it against action.Directory to rule out path
+		// traversal (e.g. "../../../.ssh/authorized_keys").
+		name := filepath.Base(attachment.Filename)
+		if name == "" || name == "." || name == string(filepath.Separator) {
+			lastErr = fmt.Errorf("attachment has unusable filename %q", attachment.Filename)
+			continue
+		}
+
+		path := filepath.Join(action.Directory, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			lastErr = fmt.Errorf("could not save attachment to %s: %v", path, err)
+			continue
+		}
+		saved++
+	}
+
+	if saved == 0 && lastErr != nil {
+		return lastErr
+	}
+	return nil
+}
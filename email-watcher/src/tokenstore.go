@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+const (
+	keyringService         = "ai-thing"
+	keyringUser            = "gmail_token"
+	encryptedTokenFileName = "gmail_token.enc"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// TokenStore persists and retrieves the OAuth token used to talk to Gmail.
+type TokenStore interface {
+	Load() (*oauth2.Token, error)
+	Save(token *oauth2.Token) error
+}
+
+// selectTokenStore builds the TokenStore named by kind ("file", "keyring", or
+// "encrypted-file"; "file" if empty) and migrates any existing plaintext
+// token into it.
+func selectTokenStore(kind string) (TokenStore, error) {
+	if kind == "" {
+		kind = "file"
+	}
+
+	var store TokenStore
+	switch kind {
+	case "file":
+		store = &FileTokenStore{}
+	case "keyring":
+		store = &KeyringTokenStore{}
+	case "encrypted-file":
+		store = &EncryptedFileTokenStore{}
+	default:
+		return nil, fmt.Errorf("unknown token store %q (want file, keyring, or encrypted-file)", kind)
+	}
+
+	if kind != "file" {
+		if err := migratePlaintextToken(store); err != nil {
+			log.Printf("Warning: could not migrate existing plaintext token: %v", err)
+		}
+	}
+
+	return store, nil
+}
+
+// migratePlaintextToken copies the legacy plaintext token file into dest and
+// removes it, so users switching --token-store don't have to re-authenticate.
+func migratePlaintextToken(dest TokenStore) error {
+	tokenPath, err := getTokenFilePath()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(tokenPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not read existing token file %s: %v", tokenPath, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return fmt.Errorf("could not parse existing token file %s: %v", tokenPath, err)
+	}
+
+	if err := dest.Save(&token); err != nil {
+		return fmt.Errorf("could not migrate token to new store: %v", err)
+	}
+
+	if err := os.Remove(tokenPath); err != nil {
+		return fmt.Errorf("could not remove plaintext token file %s after migration: %v", tokenPath, err)
+	}
+
+	log.Printf("Migrated plaintext token from %s to the selected token store", tokenPath)
+	return nil
+}
+
+// FileTokenStore is the original plaintext-on-disk token store.
+type FileTokenStore struct{}
+
+func (s *FileTokenStore) Load() (*oauth2.Token, error) {
+	tokenPath, err := getTokenFilePath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token file %s: %v", tokenPath, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("could not parse token: %v", err)
+	}
+
+	return &token, nil
+}
+
+func (s *FileTokenStore) Save(token *oauth2.Token) error {
+	tokenPath, err := getTokenFilePath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %v", err)
+	}
+
+	if err := os.WriteFile(tokenPath, data, 0600); err != nil {
+		return fmt.Errorf("could not write token file %s: %v", tokenPath, err)
+	}
+
+	return nil
+}
+
+// KeyringTokenStore stores the token in the OS keyring (Keychain on macOS,
+// Secret Service on Linux, Credential Manager on Windows).
+type KeyringTokenStore struct{}
+
+func (s *KeyringTokenStore) Load() (*oauth2.Token, error) {
+	secret, err := keyring.Get(keyringService, keyringUser)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token from OS keyring: %v", err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal([]byte(secret), &token); err != nil {
+		return nil, fmt.Errorf("could not parse token from keyring: %v", err)
+	}
+
+	return &token, nil
+}
+
+func (s *KeyringTokenStore) Save(token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %v", err)
+	}
+
+	if err := keyring.Set(keyringService, keyringUser, string(data)); err != nil {
+		return fmt.Errorf("could not save token to OS keyring: %v", err)
+	}
+
+	return nil
+}
+
+// EncryptedFileTokenStore stores the token NaCl-secretbox-encrypted under a
+// key derived (via scrypt) from a passphrase, for users who don't have or
+// don't trust an OS keyring.
+type EncryptedFileTokenStore struct{}
+
+func (s *EncryptedFileTokenStore) path() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not get home directory: %v", err)
+	}
+
+	path := filepath.Join(homeDir, tokenSubdir, encryptedTokenFileName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("could not create token directory: %v", err)
+	}
+
+	return path, nil
+}
+
+func (s *EncryptedFileTokenStore) Load() (*oauth2.Token, error) {
+	path, err := s.path()
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read encrypted token file %s: %v", path, err)
+	}
+	if len(blob) < 16+24 {
+		return nil, fmt.Errorf("encrypted token file %s is truncated", path)
+	}
+
+	salt := blob[:16]
+	var nonce [24]byte
+	copy(nonce[:], blob[16:40])
+	ciphertext := blob[40:]
+
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveTokenKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := secretbox.Open(nil, ciphertext, &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("could not decrypt %s: wrong passphrase or corrupted file", path)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("could not parse decrypted token: %v", err)
+	}
+
+	return &token, nil
+}
+
+func (s *EncryptedFileTokenStore) Save(token *oauth2.Token) error {
+	path, err := s.path()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("could not marshal token: %v", err)
+	}
+
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("could not generate salt: %v", err)
+	}
+
+	key, err := deriveTokenKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("could not generate nonce: %v", err)
+	}
+
+	ciphertext := secretbox.Seal(nil, plaintext, &nonce, key)
+
+	blob := make([]byte, 0, len(salt)+len(nonce)+len(ciphertext))
+	blob = append(blob, salt...)
+	blob = append(blob, nonce[:]...)
+	blob = append(blob, ciphertext...)
+
+	if err := os.WriteFile(path, blob, 0600); err != nil {
+		return fmt.Errorf("could not write encrypted token file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// deriveTokenKey derives a 32-byte secretbox key from passphrase and salt
+// using scrypt.
+func deriveTokenKey(passphrase, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %v", err)
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// tokenPassphrase reads the encryption passphrase from
+// AI_THING_TOKEN_PASSPHRASE, prompting on stdin if it isn't set.
+func tokenPassphrase() ([]byte, error) {
+	if pass := os.Getenv("AI_THING_TOKEN_PASSPHRASE"); pass != "" {
+		return []byte(pass), nil
+	}
+
+	fmt.Print("Enter token store passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, fmt.Errorf("could not read passphrase: %v", err)
+	}
+
+	return passphrase, nil
+}